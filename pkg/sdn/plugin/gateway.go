@@ -0,0 +1,395 @@
+package plugin
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+
+	osapi "github.com/openshift/origin/pkg/sdn/api"
+)
+
+// GatewayPoolLabel marks a Node as a candidate for centralized-egress
+// duty within the named pool, e.g.
+// sdn.network.openshift.io/gateway-pool=us-east-1a.
+const GatewayPoolLabel = "sdn.network.openshift.io/gateway-pool"
+
+// GatewayHealthCheckConfig configures the health probe that gates a
+// gateway candidate before it is considered eligible for election. It is
+// populated from the --gateway-healthcheck-interval (and friends) CLI
+// flags by the caller.
+type GatewayHealthCheckConfig struct {
+	// Interval between probes of the active gateway(s).
+	Interval time.Duration
+	// TargetPort is the TCP port probed on each candidate gateway node's
+	// own IP (not a single shared target), so the probe can tell one
+	// gateway's health apart from another's. Ignored for Protocol ==
+	// "icmp", which pings the node's IP directly.
+	TargetPort int
+	// Protocol is "tcp" or "icmp". If empty, "tcp" is assumed; health
+	// checking is disabled altogether (nodes are considered healthy
+	// whenever Ready) unless Protocol == "icmp" or TargetPort > 0.
+	Protocol string
+	// FailoverHysteresis is the minimum time between two failovers of the
+	// same pool, so a flapping node doesn't churn egress rules. The pool's
+	// initial election is not a failover and doesn't start the window. How
+	// long an active gateway has been unhealthy is not tracked: it is
+	// replaced as soon as the window since the previous failover has passed.
+	FailoverHysteresis time.Duration
+	// ActiveCount is how many gateways to keep active per pool (1 for
+	// active/standby, >1 for active/active ECMP).
+	ActiveCount int
+}
+
+func (c GatewayHealthCheckConfig) activeCount() int {
+	if c.ActiveCount < 1 {
+		return 1
+	}
+	return c.ActiveCount
+}
+
+// enabled reports whether there's enough configuration to actually probe
+// each candidate node, as opposed to relying on Node readiness alone.
+func (c GatewayHealthCheckConfig) enabled() bool {
+	return c.Protocol == "icmp" || c.TargetPort > 0
+}
+
+// SetGatewayHealthCheckConfig enables the centralized-egress gateway
+// election and configures its health check, mirroring how
+// SetOrphanSubnetTTL configures the subnet-reconcile subsystem.
+// SubnetStartMaster starts the election loop with this config if it's
+// been called beforehand; clusters that don't use gateway pools needn't
+// call it, and the election loop is never started.
+func (master *OsdnMaster) SetGatewayHealthCheckConfig(cfg GatewayHealthCheckConfig) {
+	master.gatewayHealthCheckConfig = cfg
+	master.gatewayElectionEnabled = true
+}
+
+// gatewayPoolState tracks one gateway-pool's election state. Readiness
+// and the health probe are independent signals that both feed into
+// healthy, via setReady/setProbeFailed, so a probeActive result isn't
+// clobbered by the next syncPools tick (or vice versa): a candidate is
+// only healthy while it's both Ready and passing its probe (when one is
+// configured).
+type gatewayPoolState struct {
+	name       string
+	candidates []string // node names, in priority order (sorted by name)
+	active     []string // currently elected, subset of candidates
+
+	ready       map[string]bool // from Node readiness, set by syncPools
+	probeFailed map[string]bool // from the health probe, set by probeActive
+	healthy     map[string]bool // ready && !probeFailed
+
+	lastChange time.Time
+}
+
+func newGatewayPoolState(name string) *gatewayPoolState {
+	return &gatewayPoolState{
+		name:        name,
+		ready:       make(map[string]bool),
+		probeFailed: make(map[string]bool),
+		healthy:     make(map[string]bool),
+	}
+}
+
+func (state *gatewayPoolState) setReady(name string, isReady bool) {
+	state.ready[name] = isReady
+	state.healthy[name] = isReady && !state.probeFailed[name]
+}
+
+func (state *gatewayPoolState) setProbeFailed(name string, failed bool) {
+	state.probeFailed[name] = failed
+	state.healthy[name] = state.ready[name] && !failed
+}
+
+// gatewayNodeLister is the minimal client gatewayElector needs to discover
+// pool candidates and resolve a candidate's own IP for health probing.
+// Narrowed down from kclient.Interface's Nodes(), the same way nodeGetter
+// is narrowed down for zoneIPAM, so tests can fake it without the rest of
+// the client surface.
+type gatewayNodeLister interface {
+	List(kapi.ListOptions) (*kapi.NodeList, error)
+	Get(name string) (*kapi.Node, error)
+}
+
+// gatewayHostSubnetSetter is the minimal client setHostSubnetGateway needs
+// to stamp a failover decision onto a node's HostSubnet. It mirrors the
+// Get/Update shape of the generated HostSubnets() client, the same way
+// ClusterSubnetAllocationsInterface does for the "api" IPAM backend.
+type gatewayHostSubnetSetter interface {
+	Get(name string) (*osapi.HostSubnet, error)
+	Update(*osapi.HostSubnet) (*osapi.HostSubnet, error)
+}
+
+// gatewayElector runs the centralized-egress gateway election: it watches
+// Node readiness and the GatewayPoolLabel,
+// maintains a priority list per pool, and on failover updates the
+// affected HostSubnets so every node's watchSubnets re-programs egress
+// routes via AddHostSubnetRules.
+type gatewayElector struct {
+	nodes       gatewayNodeLister
+	hostSubnets gatewayHostSubnetSetter
+	cfg         GatewayHealthCheckConfig
+
+	// probe runs the configured health check against a resolved
+	// protocol/target pair. It defaults to probeGateway; tests swap it out
+	// so they don't depend on real network access.
+	probe func(protocol, target string) bool
+
+	lock  sync.Mutex
+	pools map[string]*gatewayPoolState
+}
+
+func newGatewayElector(nodes gatewayNodeLister, hostSubnets gatewayHostSubnetSetter, cfg GatewayHealthCheckConfig) *gatewayElector {
+	return &gatewayElector{
+		nodes:       nodes,
+		hostSubnets: hostSubnets,
+		cfg:         cfg,
+		probe:       probeGateway,
+		pools:       make(map[string]*gatewayPoolState),
+	}
+}
+
+// StartGatewayElection begins watching for gateway-pool candidates and
+// electing active egress gateways per pool. It is only meaningful in
+// centralized-egress deployments; callers that don't use egress pools
+// needn't call it.
+func (master *OsdnMaster) StartGatewayElection(cfg GatewayHealthCheckConfig) {
+	e := newGatewayElector(master.kClient.Nodes(), master.osClient.HostSubnets(), cfg)
+	go utilwaitUntilForever(e.syncPools, 0)
+	if cfg.Interval > 0 {
+		go utilwaitUntilForever(e.probeActive, cfg.Interval)
+	}
+}
+
+// utilwaitUntilForever matches the repo's utilwait.Forever/Until signatures
+// without importing a second alias of the same package for a zero-period
+// "run once immediately, then every period" loop.
+func utilwaitUntilForever(f func(), period time.Duration) {
+	if period <= 0 {
+		period = 10 * time.Second
+	}
+	for {
+		f()
+		time.Sleep(period)
+	}
+}
+
+// syncPools rebuilds each pool's candidate list from current Nodes and
+// re-evaluates who should be active.
+func (e *gatewayElector) syncPools() {
+	nodes, err := e.nodes.List(kapi.ListOptions{})
+	if err != nil {
+		log.Errorf("gateway election: failed to list nodes: %v", err)
+		return
+	}
+
+	byPool := make(map[string][]string)
+	ready := make(map[string]bool)
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		pool, ok := node.Labels[GatewayPoolLabel]
+		if !ok || pool == "" {
+			continue
+		}
+		byPool[pool] = append(byPool[pool], node.Name)
+		ready[node.Name] = nodeIsReady(node)
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	for pool, candidates := range byPool {
+		sort.Strings(candidates)
+		state, exists := e.pools[pool]
+		if !exists {
+			state = newGatewayPoolState(pool)
+			e.pools[pool] = state
+		}
+		state.candidates = candidates
+		for _, name := range candidates {
+			state.setReady(name, ready[name])
+		}
+		e.elect(state)
+	}
+}
+
+// computeActiveGateways returns which of candidates (in priority order)
+// should be active, given their health and the desired active count.
+// It's a pure function, separated out of elect, so the failover math can
+// be unit-tested without a real master/Node watch.
+func computeActiveGateways(candidates []string, healthy map[string]bool, activeCount int) []string {
+	healthyList := make([]string, 0, len(candidates))
+	for _, name := range candidates {
+		if healthy[name] {
+			healthyList = append(healthyList, name)
+		}
+	}
+
+	want := activeCount
+	if want > len(healthyList) {
+		want = len(healthyList)
+	}
+	return healthyList[:want]
+}
+
+// elect recomputes state.active from the pool's healthy candidates,
+// honoring FailoverHysteresis, and persists any change onto the affected
+// HostSubnets.
+func (e *gatewayElector) elect(state *gatewayPoolState) {
+	newActive := computeActiveGateways(state.candidates, state.healthy, e.cfg.activeCount())
+
+	if stringSlicesEqual(state.active, newActive) {
+		return
+	}
+	if !state.lastChange.IsZero() && time.Since(state.lastChange) < e.cfg.FailoverHysteresis {
+		log.V(4).Infof("gateway election: pool %s failover suppressed by hysteresis window", state.name)
+		return
+	}
+
+	oldActive := state.active
+	state.active = newActive
+	// Only a failover starts the hysteresis window, not the initial election.
+	if len(oldActive) > 0 {
+		state.lastChange = time.Now()
+	}
+	log.Infof("gateway election: pool %s active gateways now %v (was %v)", state.name, newActive, oldActive)
+
+	affected := make(map[string]bool)
+	for _, name := range oldActive {
+		affected[name] = true
+	}
+	for _, name := range newActive {
+		affected[name] = true
+	}
+	for name := range affected {
+		active := false
+		for _, a := range newActive {
+			if a == name {
+				active = true
+				break
+			}
+		}
+		if err := setHostSubnetGateway(e.hostSubnets, name, state.name, active); err != nil {
+			log.Errorf("gateway election: failed to update HostSubnet %s for pool %s: %v", name, state.name, err)
+		}
+	}
+}
+
+// probeActive health-checks every currently-active gateway individually,
+// at its own IP, and demotes any that fails, promoting the next healthy
+// standby. The result is merged into state.healthy via setProbeFailed, not
+// written over it, so it isn't immediately erased by the next syncPools
+// tick as long as the node stays Ready.
+func (e *gatewayElector) probeActive() {
+	if !e.cfg.enabled() {
+		return
+	}
+
+	e.lock.Lock()
+	pools := make([]*gatewayPoolState, 0, len(e.pools))
+	for _, state := range e.pools {
+		pools = append(pools, state)
+	}
+	e.lock.Unlock()
+
+	for _, state := range pools {
+		e.lock.Lock()
+		active := append([]string(nil), state.active...)
+		e.lock.Unlock()
+
+		for _, name := range active {
+			healthy := e.probeNode(name)
+			e.lock.Lock()
+			state.setProbeFailed(name, !healthy)
+			e.lock.Unlock()
+			if !healthy {
+				log.Warningf("gateway election: health probe failed for active gateway %s (pool %s)", name, state.name)
+			}
+		}
+
+		e.lock.Lock()
+		e.elect(state)
+		e.lock.Unlock()
+	}
+}
+
+// probeNode runs the configured health check against nodeName's own IP,
+// not a single shared target, so one flaky external endpoint can't flip
+// every active gateway in every pool at once, and an individually-broken
+// gateway node is actually detected.
+func (e *gatewayElector) probeNode(nodeName string) bool {
+	node, err := e.nodes.Get(nodeName)
+	if err != nil {
+		log.Errorf("gateway election: failed to look up node %s for health probe: %v", nodeName, err)
+		return false
+	}
+	ip, err := getNodeIP(node)
+	if err != nil {
+		log.Errorf("gateway election: failed to get IP for node %s for health probe: %v", nodeName, err)
+		return false
+	}
+
+	if e.cfg.Protocol == "icmp" {
+		return e.probe("icmp", ip)
+	}
+	return e.probe(e.cfg.Protocol, net.JoinHostPort(ip, strconv.Itoa(e.cfg.TargetPort)))
+}
+
+// probeGateway runs a single TCP or ICMP health check against target,
+// returning whether it succeeded.
+func probeGateway(protocol, target string) bool {
+	switch protocol {
+	case "", "tcp":
+		conn, err := net.DialTimeout("tcp", target, 2*time.Second)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	case "icmp":
+		// No raw-socket ICMP library is vendored here; shell out to the
+		// system ping binary, which is what every node image already has.
+		cmd := exec.Command("ping", "-c", "1", "-W", "2", target)
+		return cmd.Run() == nil
+	default:
+		log.Errorf("gateway election: unknown health-check protocol %q", protocol)
+		return false
+	}
+}
+
+func nodeIsReady(node *kapi.Node) bool {
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == kapi.NodeReady {
+			return cond.Status == kapi.ConditionTrue
+		}
+	}
+	return false
+}
+
+// setHostSubnetGateway stamps the EgressGateway/EgressGatewayActive fields
+// on the named node's HostSubnet. watchSubnets on every node observes the
+// Update and re-programs egress routes via AddHostSubnetRules.
+func setHostSubnetGateway(hostSubnets gatewayHostSubnetSetter, nodeName, pool string, active bool) error {
+	sub, err := hostSubnets.Get(nodeName)
+	if err != nil {
+		return fmt.Errorf("Error fetching subnet for gateway node %q: %v", nodeName, err)
+	}
+	if sub.EgressGateway == pool && sub.EgressGatewayActive == active {
+		return nil
+	}
+	sub.EgressGateway = pool
+	sub.EgressGatewayActive = active
+	_, err = hostSubnets.Update(sub)
+	if err != nil {
+		return fmt.Errorf("Error updating subnet %s for gateway node %q: %v", hostSubnetToString(sub), nodeName, err)
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package plugin
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+
+	osapi "github.com/openshift/origin/pkg/sdn/api"
+)
+
+// fakeGatewayNodes is a gatewayNodeLister backed by an in-memory node map,
+// so gatewayElector tests don't need a real client. Node readiness and IP
+// are both driven off the stored Node, the same way the real Nodes()
+// client would report them.
+type fakeGatewayNodes map[string]*kapi.Node
+
+func newFakeGatewayNode(name, ip string, ready bool) *kapi.Node {
+	status := kapi.ConditionFalse
+	if ready {
+		status = kapi.ConditionTrue
+	}
+	return &kapi.Node{
+		ObjectMeta: kapi.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{GatewayPoolLabel: "pool-a"},
+		},
+		Status: kapi.NodeStatus{
+			Addresses:  []kapi.NodeAddress{{Type: kapi.NodeInternalIP, Address: ip}},
+			Conditions: []kapi.NodeCondition{{Type: kapi.NodeReady, Status: status}},
+		},
+	}
+}
+
+func (f fakeGatewayNodes) List(kapi.ListOptions) (*kapi.NodeList, error) {
+	list := &kapi.NodeList{}
+	for _, node := range f {
+		list.Items = append(list.Items, *node)
+	}
+	return list, nil
+}
+
+func (f fakeGatewayNodes) Get(name string) (*kapi.Node, error) {
+	node, ok := f[name]
+	if !ok {
+		return nil, fmt.Errorf("no such node %q", name)
+	}
+	return node, nil
+}
+
+// fakeGatewayHostSubnets is a gatewayHostSubnetSetter backed by an
+// in-memory nodeName->HostSubnet map, standing in for the real
+// osClient.HostSubnets() client.
+type fakeGatewayHostSubnets map[string]*osapi.HostSubnet
+
+func (f fakeGatewayHostSubnets) Get(name string) (*osapi.HostSubnet, error) {
+	sub, ok := f[name]
+	if !ok {
+		return nil, fmt.Errorf("no such HostSubnet %q", name)
+	}
+	out := *sub
+	return &out, nil
+}
+
+func (f fakeGatewayHostSubnets) Update(sub *osapi.HostSubnet) (*osapi.HostSubnet, error) {
+	out := *sub
+	f[sub.ObjectMeta.Name] = &out
+	return &out, nil
+}
+
+// TestGatewayElectionEndToEndFailover drives syncPools end-to-end through
+// a fake client for the three-node scenario chunk0-3 asks for: the active
+// gateway's Node goes NotReady and a standby is promoted within one
+// syncPools pass (standing in for one probe interval), with the resulting
+// HostSubnets actually updated so watchSubnets would re-program routes.
+func TestGatewayElectionEndToEndFailover(t *testing.T) {
+	nodes := fakeGatewayNodes{
+		"node-a": newFakeGatewayNode("node-a", "10.0.0.1", true),
+		"node-b": newFakeGatewayNode("node-b", "10.0.0.2", true),
+		"node-c": newFakeGatewayNode("node-c", "10.0.0.3", true),
+	}
+	hostSubnets := fakeGatewayHostSubnets{
+		"node-a": {ObjectMeta: kapi.ObjectMeta{Name: "node-a"}, Host: "node-a"},
+		"node-b": {ObjectMeta: kapi.ObjectMeta{Name: "node-b"}, Host: "node-b"},
+		"node-c": {ObjectMeta: kapi.ObjectMeta{Name: "node-c"}, Host: "node-c"},
+	}
+
+	e := newGatewayElector(nodes, hostSubnets, GatewayHealthCheckConfig{})
+	e.syncPools()
+
+	state := e.pools["pool-a"]
+	if state == nil {
+		t.Fatalf("expected pool-a to be discovered")
+	}
+	if !reflect.DeepEqual(state.active, []string{"node-a"}) {
+		t.Fatalf("expected node-a active initially, got %v", state.active)
+	}
+	if !hostSubnets["node-a"].EgressGatewayActive {
+		t.Errorf("expected node-a's HostSubnet to be marked active")
+	}
+
+	// node-a's Node goes NotReady; the next syncPools pass must promote
+	// node-b within that single pass, and persist it onto the HostSubnets.
+	nodes["node-a"] = newFakeGatewayNode("node-a", "10.0.0.1", false)
+	e.syncPools()
+
+	if !reflect.DeepEqual(state.active, []string{"node-b"}) {
+		t.Fatalf("expected node-b promoted after node-a went NotReady, got %v", state.active)
+	}
+	if hostSubnets["node-a"].EgressGatewayActive {
+		t.Errorf("expected node-a's HostSubnet to be demoted")
+	}
+	if !hostSubnets["node-b"].EgressGatewayActive {
+		t.Errorf("expected node-b's HostSubnet to be promoted")
+	}
+}
+
+// TestGatewayElectionFailoverHysteresis verifies that a second failover of
+// the same pool is suppressed until FailoverHysteresis has elapsed since
+// the previous one, so a flapping node doesn't churn egress rules on every
+// syncPools pass.
+func TestGatewayElectionFailoverHysteresis(t *testing.T) {
+	nodes := fakeGatewayNodes{
+		"node-a": newFakeGatewayNode("node-a", "10.0.0.1", true),
+		"node-b": newFakeGatewayNode("node-b", "10.0.0.2", true),
+		"node-c": newFakeGatewayNode("node-c", "10.0.0.3", true),
+	}
+	hostSubnets := fakeGatewayHostSubnets{
+		"node-a": {ObjectMeta: kapi.ObjectMeta{Name: "node-a"}, Host: "node-a"},
+		"node-b": {ObjectMeta: kapi.ObjectMeta{Name: "node-b"}, Host: "node-b"},
+		"node-c": {ObjectMeta: kapi.ObjectMeta{Name: "node-c"}, Host: "node-c"},
+	}
+
+	e := newGatewayElector(nodes, hostSubnets, GatewayHealthCheckConfig{FailoverHysteresis: time.Hour})
+	e.syncPools()
+	state := e.pools["pool-a"]
+
+	// node-a fails; this is the pool's first failover, so it's not subject
+	// to the hysteresis window (lastChange is still zero).
+	nodes["node-a"] = newFakeGatewayNode("node-a", "10.0.0.1", false)
+	e.syncPools()
+	if !reflect.DeepEqual(state.active, []string{"node-b"}) {
+		t.Fatalf("expected node-b promoted after node-a's first failure, got %v", state.active)
+	}
+
+	// node-b fails immediately afterwards, inside the hysteresis window:
+	// the failover to node-c must be suppressed.
+	nodes["node-b"] = newFakeGatewayNode("node-b", "10.0.0.2", false)
+	e.syncPools()
+	if !reflect.DeepEqual(state.active, []string{"node-b"}) {
+		t.Fatalf("expected failover to node-c to be suppressed by hysteresis, got %v", state.active)
+	}
+
+	// Once the hysteresis window has elapsed, the suppressed failover goes
+	// through on the next pass.
+	state.lastChange = time.Now().Add(-2 * time.Hour)
+	e.syncPools()
+	if !reflect.DeepEqual(state.active, []string{"node-c"}) {
+		t.Fatalf("expected node-c promoted once the hysteresis window elapsed, got %v", state.active)
+	}
+}
+
+// TestGatewayElectionProbeMergedNotOverwritten is the regression test for
+// the syncPools/probeActive overwrite bug: a probe-driven demotion must
+// survive the next syncPools tick as long as the node stays kubelet-Ready,
+// and the probe itself must be run per-node rather than against one
+// shared target.
+func TestGatewayElectionProbeMergedNotOverwritten(t *testing.T) {
+	nodes := fakeGatewayNodes{
+		"node-a": newFakeGatewayNode("node-a", "10.0.0.1", true),
+		"node-b": newFakeGatewayNode("node-b", "10.0.0.2", true),
+	}
+	hostSubnets := fakeGatewayHostSubnets{
+		"node-a": {ObjectMeta: kapi.ObjectMeta{Name: "node-a"}, Host: "node-a"},
+		"node-b": {ObjectMeta: kapi.ObjectMeta{Name: "node-b"}, Host: "node-b"},
+	}
+
+	e := newGatewayElector(nodes, hostSubnets, GatewayHealthCheckConfig{TargetPort: 9999})
+	unhealthyIP := "10.0.0.1:9999"
+	e.probe = func(protocol, target string) bool {
+		return target != unhealthyIP
+	}
+
+	e.syncPools()
+	state := e.pools["pool-a"]
+	if !reflect.DeepEqual(state.active, []string{"node-a"}) {
+		t.Fatalf("expected node-a active before probing, got %v", state.active)
+	}
+
+	// node-a fails its probe although its Node stays Ready; node-b must be
+	// promoted, and the demotion must not be merely transient.
+	e.probeActive()
+	if !reflect.DeepEqual(state.active, []string{"node-b"}) {
+		t.Fatalf("expected node-b promoted after node-a failed its probe, got %v", state.active)
+	}
+
+	// Node readiness hasn't changed, so a plain syncPools tick must not
+	// stomp the probe-driven demotion still in effect.
+	e.syncPools()
+	if !reflect.DeepEqual(state.active, []string{"node-b"}) {
+		t.Fatalf("expected node-a's probe failure to survive a syncPools tick, got %v", state.active)
+	}
+}
+
+// TestComputeActiveGatewaysFailover exercises a three-node pool through an
+// active-node failure: the standby with the next-highest priority is
+// promoted when the active node goes unhealthy, and no gateway is active
+// once every candidate is unhealthy. Hysteresis is handled by elect, not
+// this pure function.
+func TestComputeActiveGatewaysFailover(t *testing.T) {
+	candidates := []string{"node-a", "node-b", "node-c"}
+
+	allHealthy := map[string]bool{"node-a": true, "node-b": true, "node-c": true}
+	active := computeActiveGateways(candidates, allHealthy, 1)
+	if !reflect.DeepEqual(active, []string{"node-a"}) {
+		t.Fatalf("expected node-a active with all nodes healthy, got %v", active)
+	}
+
+	nodeADown := map[string]bool{"node-a": false, "node-b": true, "node-c": true}
+	active = computeActiveGateways(candidates, nodeADown, 1)
+	if !reflect.DeepEqual(active, []string{"node-b"}) {
+		t.Fatalf("expected node-b promoted after node-a failure, got %v", active)
+	}
+
+	allDown := map[string]bool{"node-a": false, "node-b": false, "node-c": false}
+	active = computeActiveGateways(candidates, allDown, 1)
+	if len(active) != 0 {
+		t.Fatalf("expected no active gateway with every candidate unhealthy, got %v", active)
+	}
+}
+
+// TestComputeActiveGatewaysActiveActive covers ActiveCount > 1 (ECMP).
+func TestComputeActiveGatewaysActiveActive(t *testing.T) {
+	candidates := []string{"node-a", "node-b", "node-c"}
+	healthy := map[string]bool{"node-a": true, "node-b": true, "node-c": false}
+
+	active := computeActiveGateways(candidates, healthy, 2)
+	if !reflect.DeepEqual(active, []string{"node-a", "node-b"}) {
+		t.Fatalf("expected node-a and node-b active, got %v", active)
+	}
+}
+
+func TestProbeGatewayTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start listener: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	if !probeGateway("tcp", ln.Addr().String()) {
+		t.Errorf("expected probe of a listening address to succeed")
+	}
+}
+
+func TestProbeGatewayTCPFailure(t *testing.T) {
+	// Nothing is listening here; the dial should fail quickly.
+	if probeGateway("tcp", "127.0.0.1:1") {
+		t.Errorf("expected probe of a closed port to fail")
+	}
+}
+
+func TestNodeIsReady(t *testing.T) {
+	ready := &kapi.Node{Status: kapi.NodeStatus{Conditions: []kapi.NodeCondition{
+		{Type: kapi.NodeReady, Status: kapi.ConditionTrue},
+	}}}
+	if !nodeIsReady(ready) {
+		t.Errorf("expected node with Ready=True to be ready")
+	}
+
+	notReady := &kapi.Node{Status: kapi.NodeStatus{Conditions: []kapi.NodeCondition{
+		{Type: kapi.NodeReady, Status: kapi.ConditionFalse},
+	}}}
+	if nodeIsReady(notReady) {
+		t.Errorf("expected node with Ready=False to not be ready")
+	}
+
+	noCondition := &kapi.Node{}
+	if nodeIsReady(noCondition) {
+		t.Errorf("expected node with no Ready condition to not be ready")
+	}
+}
@@ -0,0 +1,392 @@
+package plugin
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	log "github.com/golang/glog"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kapiunversioned "k8s.io/kubernetes/pkg/api/unversioned"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+
+	"github.com/openshift/origin/pkg/util/netutils"
+)
+
+// IPAM is the allocation backend behind a single address family's
+// HostSubnet CIDRs. addNode/deleteNode talk only to this interface, never
+// to a concrete allocator, so operators can swap in an alternative
+// backend (see NewIPAM) without touching the subnet subsystem itself.
+type IPAM interface {
+	// Allocate returns a fresh, unused subnet for nodeName.
+	Allocate(nodeName string) (*net.IPNet, error)
+	// Release returns subnet to the pool it came from.
+	Release(subnet *net.IPNet) error
+	// Reserve marks subnet as already in use, e.g. when re-reading
+	// existing HostSubnets at startup, without assigning it to a node.
+	// It must be safe to call twice with the same subnet (double-reserve
+	// is a no-op, not an error), matching the double-release safety
+	// required of Release.
+	Reserve(subnet *net.IPNet) error
+}
+
+// NodeAwareReserver is implemented by IPAM backends that need to know
+// which node a subnet belongs to in order to reserve it correctly (e.g.
+// zoneIPAM, which must resolve the owning zone before it knows which pool
+// to reserve from). SubnetStartMaster calls ReserveForNode, in preference
+// to Reserve, for every existing HostSubnet on startup so backends that
+// need node context aren't left to silently drop pre-existing
+// allocations; backends that don't need it simply don't implement this.
+type NodeAwareReserver interface {
+	ReserveForNode(nodeName string, subnet *net.IPNet) error
+}
+
+// IPAMConfig selects and configures the IPAM backend for one address
+// family's cluster network, wired through from the SDN master config.
+type IPAMConfig struct {
+	// Backend is "range" (default, in-memory contiguous allocator),
+	// "zone" (one range-per-zone pool keyed by a node label), or "api"
+	// (CRD-backed, for coordinating multiple master replicas).
+	Backend string
+	// ZoneLabel is the node label IPAMConfig{Backend: "zone"} partitions
+	// on, e.g. "topology.kubernetes.io/zone". Required for "zone".
+	ZoneLabel string
+	// ZonePrefixLength is the extra number of bits each zone's pool
+	// claims out of the cluster CIDR, so zone pools don't overlap. E.g.
+	// for a /16 cluster network and 4 zones, a ZonePrefixLength of 2
+	// gives each zone a /18.
+	ZonePrefixLength uint32
+	// ClusterSubnetAllocations is the client used by the "api" backend to
+	// persist allocation state in a ClusterSubnetAllocation object.
+	// Required when Backend == "api".
+	ClusterSubnetAllocations ClusterSubnetAllocationsInterface
+}
+
+func (c IPAMConfig) backend() string {
+	if c.Backend == "" {
+		return "range"
+	}
+	return c.Backend
+}
+
+// NewIPAM builds the configured IPAM backend for one address family,
+// pre-reserving existingSubnets (HostSubnets already on record from a
+// previous master run).
+func NewIPAM(kClient kclient.Interface, clusterNetwork *net.IPNet, hostSubnetLength uint32, existingSubnets []string, cfg IPAMConfig) (IPAM, error) {
+	switch cfg.backend() {
+	case "range":
+		return newRangeIPAM(clusterNetwork, hostSubnetLength, existingSubnets)
+	case "zone":
+		return newZoneIPAM(kClient.Nodes(), clusterNetwork, hostSubnetLength, existingSubnets, cfg)
+	case "api":
+		if cfg.ClusterSubnetAllocations == nil {
+			return nil, fmt.Errorf("IPAM backend %q requires ClusterSubnetAllocations", cfg.Backend)
+		}
+		return newAPIIPAM(cfg.ClusterSubnetAllocations, clusterNetwork, hostSubnetLength, existingSubnets)
+	default:
+		return nil, fmt.Errorf("unknown IPAM backend %q", cfg.Backend)
+	}
+}
+
+// rangeIPAM is the original single contiguous-range allocator, wrapped
+// behind the IPAM interface.
+type rangeIPAM struct {
+	allocator *netutils.SubnetAllocator
+}
+
+func newRangeIPAM(clusterNetwork *net.IPNet, hostSubnetLength uint32, existingSubnets []string) (IPAM, error) {
+	allocator, err := netutils.NewSubnetAllocator(clusterNetwork.String(), hostSubnetLength, existingSubnets)
+	if err != nil {
+		return nil, err
+	}
+	return &rangeIPAM{allocator: allocator}, nil
+}
+
+func (r *rangeIPAM) Allocate(nodeName string) (*net.IPNet, error) {
+	return r.allocator.GetNetwork()
+}
+
+func (r *rangeIPAM) Release(subnet *net.IPNet) error {
+	r.allocator.ReleaseNetwork(subnet)
+	return nil
+}
+
+func (r *rangeIPAM) Reserve(subnet *net.IPNet) error {
+	return r.allocator.MarkAllocatedNetwork(subnet)
+}
+
+func (r *rangeIPAM) FreeNetworks() int {
+	return r.allocator.FreeNetworks()
+}
+
+// nodeGetter is the minimal client zoneIPAM needs to resolve a node's
+// zone label, scoped down from kclient.Interface so zoneIPAM doesn't drag
+// in the rest of the client surface and so tests can fake it trivially.
+// kclient.Interface's Nodes() already satisfies it.
+type nodeGetter interface {
+	Get(name string) (*kapi.Node, error)
+}
+
+// zoneIPAM partitions the cluster network into one rangeIPAM pool per
+// distinct value of a node label (e.g. the failure-domain zone), so that
+// all HostSubnets in a zone share a summarizable parent CIDR and a ToR
+// switch only needs one aggregate route per zone.
+type zoneIPAM struct {
+	nodes     nodeGetter
+	zoneLabel string
+
+	lock  sync.Mutex
+	zones map[string]IPAM
+
+	clusterNetwork   *net.IPNet
+	hostSubnetLength uint32
+	zonePrefixLength uint32
+	nextZoneIndex    int
+}
+
+func newZoneIPAM(nodes nodeGetter, clusterNetwork *net.IPNet, hostSubnetLength uint32, existingSubnets []string, cfg IPAMConfig) (IPAM, error) {
+	if cfg.ZoneLabel == "" {
+		return nil, fmt.Errorf("IPAM backend %q requires ZoneLabel", cfg.Backend)
+	}
+	z := &zoneIPAM{
+		nodes:            nodes,
+		zoneLabel:        cfg.ZoneLabel,
+		zones:            make(map[string]IPAM),
+		clusterNetwork:   clusterNetwork,
+		hostSubnetLength: hostSubnetLength,
+		zonePrefixLength: cfg.ZonePrefixLength,
+	}
+	// existingSubnets can't be reserved here: a bare CIDR doesn't carry
+	// its owning zone, and zoneIPAM partitions by zone. SubnetStartMaster
+	// instead calls ReserveForNode per existing HostSubnet once it's
+	// built the allocators, which resolves each subnet's zone via its
+	// Host and reserves it from (creating if necessary) that zone's pool.
+	if len(existingSubnets) > 0 {
+		log.V(2).Infof("zone IPAM: deferring reservation of %d existing subnets to the per-node ReserveForNode pass", len(existingSubnets))
+	}
+	return z, nil
+}
+
+// zonePool returns (creating if necessary) the pool for zone.
+func (z *zoneIPAM) zonePool(zone string) (IPAM, error) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+
+	if pool, ok := z.zones[zone]; ok {
+		return pool, nil
+	}
+
+	zoneCIDR, err := netutils.CarveZoneCIDR(z.clusterNetwork, z.zonePrefixLength, z.nextZoneIndex)
+	if err != nil {
+		return nil, fmt.Errorf("zone IPAM: failed to carve pool for zone %q: %v", zone, err)
+	}
+	z.nextZoneIndex++
+
+	pool, err := newRangeIPAM(zoneCIDR, z.hostSubnetLength, nil)
+	if err != nil {
+		return nil, err
+	}
+	z.zones[zone] = pool
+	return pool, nil
+}
+
+func (z *zoneIPAM) nodeZone(nodeName string) (string, error) {
+	node, err := z.nodes.Get(nodeName)
+	if err != nil {
+		return "", fmt.Errorf("zone IPAM: failed to look up node %s: %v", nodeName, err)
+	}
+	zone, ok := node.Labels[z.zoneLabel]
+	if !ok || zone == "" {
+		return "", fmt.Errorf("zone IPAM: node %s has no %s label", nodeName, z.zoneLabel)
+	}
+	return zone, nil
+}
+
+func (z *zoneIPAM) Allocate(nodeName string) (*net.IPNet, error) {
+	zone, err := z.nodeZone(nodeName)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := z.zonePool(zone)
+	if err != nil {
+		return nil, err
+	}
+	return pool.Allocate(nodeName)
+}
+
+func (z *zoneIPAM) Release(subnet *net.IPNet) error {
+	z.lock.Lock()
+	pools := make([]IPAM, 0, len(z.zones))
+	for _, pool := range z.zones {
+		pools = append(pools, pool)
+	}
+	z.lock.Unlock()
+
+	// We don't track which zone owns which already-allocated subnet, so
+	// ask every pool; only the one that actually holds it will do
+	// anything. This keeps Release double-release-safe, as required.
+	var lastErr error
+	for _, pool := range pools {
+		if err := pool.Release(subnet); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (z *zoneIPAM) Reserve(subnet *net.IPNet) error {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	for _, pool := range z.zones {
+		if err := pool.Reserve(subnet); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("zone IPAM: %s does not belong to any known zone pool", subnet.String())
+}
+
+// ReserveForNode reserves subnet out of nodeName's zone pool, creating
+// that pool first if this is the first subnet reserved or allocated for
+// it. Unlike Reserve, this works for a subnet whose zone pool hasn't been
+// created yet, which is the common case right after master startup
+// before any Allocate call has touched that zone.
+func (z *zoneIPAM) ReserveForNode(nodeName string, subnet *net.IPNet) error {
+	zone, err := z.nodeZone(nodeName)
+	if err != nil {
+		return err
+	}
+	pool, err := z.zonePool(zone)
+	if err != nil {
+		return err
+	}
+	return pool.Reserve(subnet)
+}
+
+// ClusterSubnetAllocationsInterface is the client the "api" IPAM backend
+// uses to persist allocation state in a ClusterSubnetAllocation object, so
+// multiple master replicas can coordinate through the API server's
+// optimistic concurrency (resourceVersion conflicts) rather than each
+// holding independent in-memory state. It mirrors the Get/Create/Update
+// shape of the generated HostSubnets() client elsewhere in this package;
+// the concrete implementation lives with the rest of the generated CRD
+// clients, not in the SDN plugin.
+type ClusterSubnetAllocationsInterface interface {
+	GetOrCreate(name string) (*ClusterSubnetAllocation, error)
+	Update(*ClusterSubnetAllocation) error
+}
+
+// apiIPAM persists allocation state in a ClusterSubnetAllocation object so
+// multiple master replicas can coordinate through the API server's
+// optimistic concurrency (resourceVersion conflicts) instead of each
+// holding independent in-memory state.
+type apiIPAM struct {
+	client           ClusterSubnetAllocationsInterface
+	clusterNetwork   *net.IPNet
+	hostSubnetLength uint32
+}
+
+func newAPIIPAM(client ClusterSubnetAllocationsInterface, clusterNetwork *net.IPNet, hostSubnetLength uint32, existingSubnets []string) (IPAM, error) {
+	a := &apiIPAM{
+		client:           client,
+		clusterNetwork:   clusterNetwork,
+		hostSubnetLength: hostSubnetLength,
+	}
+	for _, subnet := range existingSubnets {
+		_, ipnet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return nil, fmt.Errorf("api IPAM: invalid existing subnet %q: %v", subnet, err)
+		}
+		if err := a.Reserve(ipnet); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// withClusterSubnetAllocation retries fn against the current
+// ClusterSubnetAllocation on resourceVersion conflicts, the same pattern
+// clearInitialNodeNetworkUnavailableCondition uses for Node updates.
+func (a *apiIPAM) withClusterSubnetAllocation(fn func(alloc *ClusterSubnetAllocation) error) error {
+	return kclient.RetryOnConflict(kclient.DefaultBackoff, func() error {
+		alloc, err := a.client.GetOrCreate(a.clusterNetwork.String())
+		if err != nil {
+			return err
+		}
+		if err := fn(alloc); err != nil {
+			return err
+		}
+		return a.client.Update(alloc)
+	})
+}
+
+func (a *apiIPAM) Allocate(nodeName string) (*net.IPNet, error) {
+	var allocated *net.IPNet
+	err := a.withClusterSubnetAllocation(func(alloc *ClusterSubnetAllocation) error {
+		sn, err := alloc.allocate(a.clusterNetwork, a.hostSubnetLength)
+		if err != nil {
+			return err
+		}
+		allocated = sn
+		return nil
+	})
+	return allocated, err
+}
+
+func (a *apiIPAM) Release(subnet *net.IPNet) error {
+	return a.withClusterSubnetAllocation(func(alloc *ClusterSubnetAllocation) error {
+		alloc.release(subnet)
+		return nil
+	})
+}
+
+func (a *apiIPAM) Reserve(subnet *net.IPNet) error {
+	return a.withClusterSubnetAllocation(func(alloc *ClusterSubnetAllocation) error {
+		alloc.reserve(subnet)
+		return nil
+	})
+}
+
+// ClusterSubnetAllocation is the CRD-backed record apiIPAM coordinates
+// through. It's intentionally a plain allocated-CIDR bitmap rather than a
+// copy of netutils.SubnetAllocator's internals, so the on-disk format
+// doesn't need to track that package's private state.
+type ClusterSubnetAllocation struct {
+	kapiunversioned.TypeMeta
+	kapi.ObjectMeta
+
+	Allocated []string
+}
+
+func (a *ClusterSubnetAllocation) allocate(clusterNetwork *net.IPNet, hostSubnetLength uint32) (*net.IPNet, error) {
+	used := make(map[string]bool, len(a.Allocated))
+	for _, s := range a.Allocated {
+		used[s] = true
+	}
+	sn, err := netutils.NextFreeSubnet(clusterNetwork, hostSubnetLength, used)
+	if err != nil {
+		return nil, err
+	}
+	a.Allocated = append(a.Allocated, sn.String())
+	return sn, nil
+}
+
+func (a *ClusterSubnetAllocation) release(subnet *net.IPNet) {
+	target := subnet.String()
+	for i, s := range a.Allocated {
+		if s == target {
+			a.Allocated = append(a.Allocated[:i], a.Allocated[i+1:]...)
+			return
+		}
+	}
+}
+
+func (a *ClusterSubnetAllocation) reserve(subnet *net.IPNet) {
+	target := subnet.String()
+	for _, s := range a.Allocated {
+		if s == target {
+			return
+		}
+	}
+	a.Allocated = append(a.Allocated, target)
+}
@@ -0,0 +1,195 @@
+package plugin
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+)
+
+// fakeNodeGetter is a nodeGetter backed by an in-memory nodeName->zone map,
+// so zoneIPAM tests don't need a real client.
+type fakeNodeGetter map[string]string
+
+const testZoneLabel = "topology.kubernetes.io/zone"
+
+func (f fakeNodeGetter) Get(name string) (*kapi.Node, error) {
+	zone, ok := f[name]
+	if !ok {
+		return nil, fmt.Errorf("no such node %q", name)
+	}
+	return &kapi.Node{
+		ObjectMeta: kapi.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{testZoneLabel: zone},
+		},
+	}, nil
+}
+
+// fakeClusterSubnetAllocations is an in-memory ClusterSubnetAllocationsInterface
+// for apiIPAM tests, standing in for the real CRD-backed client.
+type fakeClusterSubnetAllocations struct {
+	allocs map[string]*ClusterSubnetAllocation
+}
+
+func newFakeClusterSubnetAllocations() *fakeClusterSubnetAllocations {
+	return &fakeClusterSubnetAllocations{allocs: make(map[string]*ClusterSubnetAllocation)}
+}
+
+func (f *fakeClusterSubnetAllocations) GetOrCreate(name string) (*ClusterSubnetAllocation, error) {
+	a, ok := f.allocs[name]
+	if !ok {
+		a = &ClusterSubnetAllocation{ObjectMeta: kapi.ObjectMeta{Name: name}}
+		f.allocs[name] = a
+	}
+	out := *a
+	out.Allocated = append([]string(nil), a.Allocated...)
+	return &out, nil
+}
+
+func (f *fakeClusterSubnetAllocations) Update(a *ClusterSubnetAllocation) error {
+	stored := *a
+	stored.Allocated = append([]string(nil), a.Allocated...)
+	f.allocs[a.Name] = &stored
+	return nil
+}
+
+// runIPAMConformance is the conformance suite every IPAM backend must
+// pass: allocate-release-reallocate hands the same subnet back out,
+// releasing an already-released subnet is a safe no-op, and Allocate
+// fails once the pool is exhausted. ipam must be sized to hold exactly
+// two subnets, and nodeName/nodeName2 must both draw from that same pool
+// (e.g. the same zone, for zoneIPAM), so the exhaustion subtest -- which
+// runs last and consumes the pool's one remaining subnet -- can tell a
+// real exhaustion error apart from one of the earlier subtests simply
+// having used up a too-small pool.
+func runIPAMConformance(t *testing.T, label string, ipam IPAM, nodeName, nodeName2 string) {
+	t.Run(label+"/allocate-release-reallocate", func(t *testing.T) {
+		sn, err := ipam.Allocate(nodeName)
+		if err != nil {
+			t.Fatalf("Allocate failed: %v", err)
+		}
+		if err := ipam.Release(sn); err != nil {
+			t.Fatalf("Release failed: %v", err)
+		}
+		sn2, err := ipam.Allocate(nodeName)
+		if err != nil {
+			t.Fatalf("reallocate failed: %v", err)
+		}
+		if sn2.String() != sn.String() {
+			t.Errorf("expected the released subnet %s to be reallocated, got %s", sn, sn2)
+		}
+	})
+
+	t.Run(label+"/double-release-safety", func(t *testing.T) {
+		sn, err := ipam.Allocate(nodeName)
+		if err != nil {
+			t.Fatalf("Allocate failed: %v", err)
+		}
+		if err := ipam.Release(sn); err != nil {
+			t.Fatalf("first Release failed: %v", err)
+		}
+		if err := ipam.Release(sn); err != nil {
+			t.Errorf("second Release of an already-released subnet must be a safe no-op, got: %v", err)
+		}
+	})
+
+	t.Run(label+"/exhaustion", func(t *testing.T) {
+		// The double-release subtest above leaves the pool with one
+		// allocated (from allocate-release-reallocate) and one free
+		// subnet; this Allocate takes the last one.
+		if _, err := ipam.Allocate(nodeName); err != nil {
+			t.Fatalf("Allocate of the pool's last subnet failed: %v", err)
+		}
+		if _, err := ipam.Allocate(nodeName2); err == nil {
+			t.Errorf("expected Allocate to fail once the pool's subnets are all handed out")
+		}
+	})
+}
+
+func TestRangeIPAMConformance(t *testing.T) {
+	_, cidr, _ := net.ParseCIDR("10.42.0.0/23")
+	ipam, err := newRangeIPAM(cidr, 24, nil)
+	if err != nil {
+		t.Fatalf("newRangeIPAM failed: %v", err)
+	}
+	runIPAMConformance(t, "range", ipam, "node-a", "node-b")
+}
+
+func TestZoneIPAMConformance(t *testing.T) {
+	nodes := fakeNodeGetter{"node-a": "zone-a", "node-b": "zone-a"}
+	_, cidr, _ := net.ParseCIDR("10.43.0.0/16")
+	// ZonePrefixLength 7 carves node-a/node-b's zone down to a /23, which
+	// at hostSubnetLength 24 holds exactly the two subnets the conformance
+	// suite's exhaustion subtest needs.
+	cfg := IPAMConfig{Backend: "zone", ZoneLabel: testZoneLabel, ZonePrefixLength: 7}
+	ipam, err := newZoneIPAM(nodes, cidr, 24, nil, cfg)
+	if err != nil {
+		t.Fatalf("newZoneIPAM failed: %v", err)
+	}
+	runIPAMConformance(t, "zone", ipam, "node-a", "node-b")
+}
+
+func TestAPIIPAMConformance(t *testing.T) {
+	client := newFakeClusterSubnetAllocations()
+	_, cidr, _ := net.ParseCIDR("10.45.0.0/23")
+	ipam, err := newAPIIPAM(client, cidr, 24, nil)
+	if err != nil {
+		t.Fatalf("newAPIIPAM failed: %v", err)
+	}
+	runIPAMConformance(t, "api", ipam, "node-a", "node-b")
+}
+
+// TestNewAPIIPAMReservesExistingSubnets guards the restart-safety the
+// "api" backend already gets right: existingSubnets passed at
+// construction must not be handed back out.
+func TestNewAPIIPAMReservesExistingSubnets(t *testing.T) {
+	client := newFakeClusterSubnetAllocations()
+	_, cidr, _ := net.ParseCIDR("10.48.0.0/16")
+	_, existing, _ := net.ParseCIDR("10.48.0.0/24")
+
+	ipam, err := newAPIIPAM(client, cidr, 24, []string{existing.String()})
+	if err != nil {
+		t.Fatalf("newAPIIPAM failed: %v", err)
+	}
+	sn, err := ipam.Allocate("node-a")
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if sn.String() == existing.String() {
+		t.Errorf("Allocate handed out %s, which was passed in as an existing subnet", sn)
+	}
+}
+
+// TestZoneIPAMReserveForNodeRestartSafety is the regression test for the
+// zone-IPAM restart bug: a CIDR reserved via ReserveForNode (standing in
+// for the per-HostSubnet pass SubnetStartMaster now runs at startup) must
+// not be handed back out to a different node in the same zone.
+func TestZoneIPAMReserveForNodeRestartSafety(t *testing.T) {
+	nodes := fakeNodeGetter{"node-a": "zone-a", "node-b": "zone-a"}
+	_, cidr, _ := net.ParseCIDR("10.44.0.0/16")
+	cfg := IPAMConfig{Backend: "zone", ZoneLabel: testZoneLabel, ZonePrefixLength: 2}
+
+	ipam, err := newZoneIPAM(nodes, cidr, 24, nil, cfg)
+	if err != nil {
+		t.Fatalf("newZoneIPAM failed: %v", err)
+	}
+	reserver, ok := ipam.(NodeAwareReserver)
+	if !ok {
+		t.Fatalf("zoneIPAM must implement NodeAwareReserver")
+	}
+
+	_, existing, _ := net.ParseCIDR("10.44.0.0/24")
+	if err := reserver.ReserveForNode("node-a", existing); err != nil {
+		t.Fatalf("ReserveForNode failed: %v", err)
+	}
+
+	sn, err := ipam.Allocate("node-b")
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if sn.String() == existing.String() {
+		t.Errorf("Allocate handed out %s to node-b, but it was already reserved for node-a by a previous master run", sn)
+	}
+}
@@ -0,0 +1,89 @@
+package plugin
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "openshift_sdn"
+const metricsSubsystem = "retry"
+
+var (
+	// retryQueueDepth tracks how many node/HostSubnet objects currently
+	// have a pending retry, labeled by the owning retryQueue's name
+	// (e.g. "nodes", "hostsubnets").
+	retryQueueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "queue_depth",
+			Help:      "Number of objects currently queued for retry.",
+		},
+		[]string{"queue"},
+	)
+
+	// retryAttempts counts every retry attempt, successful or not.
+	retryAttempts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "attempts_total",
+			Help:      "Total number of retry attempts for queued objects.",
+		},
+		[]string{"queue"},
+	)
+
+	// retryTerminalFailures counts entries that have failed at least
+	// retryTerminalThreshold times in a row without clearing.
+	retryTerminalFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "terminal_failures_total",
+			Help:      "Total number of objects that have exceeded the retry terminal-failure threshold.",
+		},
+		[]string{"queue"},
+	)
+
+	// subnetsAllocated is the number of HostSubnets with a matching Node;
+	// a dual-stack HostSubnet counts once, not once per address family.
+	subnetsAllocated = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "subnets",
+			Name:      "allocated",
+			Help:      "Number of HostSubnets currently allocated to a Node.",
+		},
+	)
+
+	// subnetsFree is the number of CIDRs left in the subnet allocator(s),
+	// summed across all configured address families. Only IPAM backends
+	// that report FreeNetworks are counted; others contribute nothing.
+	subnetsFree = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "subnets",
+			Name:      "free",
+			Help:      "Number of subnet CIDRs left to allocate.",
+		},
+	)
+
+	// subnetsOrphaned is the number of HostSubnets with no matching Node,
+	// as of the last reconcile pass.
+	subnetsOrphaned = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "subnets",
+			Name:      "orphaned",
+			Help:      "Number of HostSubnets with no matching Node as of the last reconcile.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(retryQueueDepth)
+	prometheus.MustRegister(retryAttempts)
+	prometheus.MustRegister(retryTerminalFailures)
+	prometheus.MustRegister(subnetsAllocated)
+	prometheus.MustRegister(subnetsFree)
+	prometheus.MustRegister(subnetsOrphaned)
+}
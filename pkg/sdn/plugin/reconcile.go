@@ -0,0 +1,183 @@
+package plugin
+
+import (
+	"time"
+
+	log "github.com/golang/glog"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	utilwait "k8s.io/kubernetes/pkg/util/wait"
+
+	osapi "github.com/openshift/origin/pkg/sdn/api"
+)
+
+// orphanSinceAnnotation records when a HostSubnet was first found to have
+// no corresponding Node, so a grace period can be honored before deletion.
+const orphanSinceAnnotation = "sdn.network.openshift.io/orphan-since"
+
+// subnetReconcileInterval is how often the periodic resync started by
+// startSubnetReconcile runs, on top of the one-shot reconcile done at
+// master startup. The resync runs on its own timer; watchNodes events do
+// not trigger it.
+const subnetReconcileInterval = 5 * time.Minute
+
+// SetOrphanSubnetTTL configures the --orphan-subnet-ttl grace period: a
+// HostSubnet whose Node has gone away is annotated with
+// orphanSinceAnnotation and only deleted once it's been orphaned for at
+// least ttl. A zero ttl (the default) deletes orphans immediately.
+func (master *OsdnMaster) SetOrphanSubnetTTL(ttl time.Duration) {
+	master.orphanSubnetTTL = ttl
+}
+
+// reconcileSubnets lists Nodes and HostSubnets and repairs any drift
+// between them: a HostSubnet with no matching Node is orphaned (deleted,
+// or annotated and deleted after orphanSubnetTTL); a Node with no
+// HostSubnet gets one via addNode; and a HostSubnet whose HostIP(s) no
+// longer match its Node's current address is updated in place. It is run
+// once at SubnetStartMaster and again every subnetReconcileInterval from
+// the goroutine started by startSubnetReconcile, so a master that was down
+// when a Node was deleted doesn't leak that Node's subnet forever.
+func (master *OsdnMaster) reconcileSubnets() {
+	nodes, err := master.kClient.Nodes().List(kapi.ListOptions{})
+	if err != nil {
+		log.Errorf("Subnet reconcile: failed to list nodes: %v", err)
+		return
+	}
+	nodesByName := make(map[string]*kapi.Node, len(nodes.Items))
+	for i := range nodes.Items {
+		nodesByName[nodes.Items[i].Name] = &nodes.Items[i]
+	}
+
+	subnets, err := master.osClient.HostSubnets().List(kapi.ListOptions{})
+	if err != nil {
+		log.Errorf("Subnet reconcile: failed to list HostSubnets: %v", err)
+		return
+	}
+
+	families := master.subnetFamilies()
+	var allocated, orphaned float64
+	seenHosts := make(map[string]bool, len(subnets.Items))
+
+	for i := range subnets.Items {
+		sub := &subnets.Items[i]
+		seenHosts[sub.Host] = true
+		node, exists := nodesByName[sub.Host]
+		if !exists {
+			orphaned++
+			if master.reconcileOrphan(sub) {
+				continue
+			}
+			continue
+		}
+		allocated++
+
+		if _, wasOrphan := sub.Annotations[orphanSinceAnnotation]; wasOrphan {
+			master.clearOrphanAnnotation(sub)
+		}
+
+		nodeIPs, err := getNodeIPs(node, families)
+		if err != nil {
+			log.Errorf("Subnet reconcile: failed to get IPs for node %s: %v", node.Name, err)
+			continue
+		}
+		if !stringSlicesEqual(hostSubnetIPs(sub), nodeIPs) {
+			log.Infof("Subnet reconcile: HostSubnet %s HostIP(s) %v no longer match Node's %v, updating", sub.Host, hostSubnetIPs(sub), nodeIPs)
+			if err := master.addNode(sub.Host, nodeIPs); err != nil {
+				log.Errorf("Subnet reconcile: failed to update HostSubnet for node %s: %v", node.Name, err)
+			}
+		}
+	}
+
+	for name, node := range nodesByName {
+		if seenHosts[name] {
+			continue
+		}
+		log.Infof("Subnet reconcile: Node %s has no HostSubnet, creating one", name)
+		nodeIPs, err := getNodeIPs(node, families)
+		if err != nil {
+			log.Errorf("Subnet reconcile: failed to get IPs for node %s: %v", name, err)
+			continue
+		}
+		if err := master.addNode(name, nodeIPs); err != nil {
+			log.Errorf("Subnet reconcile: failed to create HostSubnet for node %s: %v", name, err)
+		}
+	}
+
+	// FreeNetworks isn't part of the IPAM interface itself (not every
+	// backend can report it cheaply, e.g. the CRD-backed one), so ask
+	// only the allocators that opt in.
+	free := 0.0
+	for _, allocator := range master.subnetAllocators {
+		if counter, ok := allocator.(interface{ FreeNetworks() int }); ok {
+			free += float64(counter.FreeNetworks())
+		}
+	}
+	subnetsAllocated.Set(allocated)
+	subnetsFree.Set(free)
+	subnetsOrphaned.Set(orphaned)
+}
+
+// reconcileOrphan handles a single HostSubnet whose Node no longer exists,
+// applying the configured grace period. It returns true if it fully
+// handled the entry (deleted, or left annotated and pending).
+func (master *OsdnMaster) reconcileOrphan(sub *osapi.HostSubnet) bool {
+	if master.orphanSubnetTTL <= 0 {
+		master.deleteOrphanSubnet(sub)
+		return true
+	}
+
+	since, annotated := sub.Annotations[orphanSinceAnnotation]
+	if !annotated {
+		master.annotateOrphan(sub)
+		return true
+	}
+
+	orphanedSince, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		log.Errorf("Subnet reconcile: invalid %s annotation on HostSubnet %s: %v", orphanSinceAnnotation, sub.Host, err)
+		master.annotateOrphan(sub)
+		return true
+	}
+	if time.Since(orphanedSince) < master.orphanSubnetTTL {
+		log.V(4).Infof("Subnet reconcile: HostSubnet %s orphaned since %s, still within %s grace period", sub.Host, since, master.orphanSubnetTTL)
+		return true
+	}
+
+	master.deleteOrphanSubnet(sub)
+	return true
+}
+
+func (master *OsdnMaster) annotateOrphan(sub *osapi.HostSubnet) {
+	log.Warningf("Subnet reconcile: HostSubnet %s has no matching Node, annotating as orphaned", sub.Host)
+	updated := *sub
+	if updated.Annotations == nil {
+		updated.Annotations = make(map[string]string)
+	}
+	updated.Annotations[orphanSinceAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	if _, err := master.osClient.HostSubnets().Update(&updated); err != nil {
+		log.Errorf("Subnet reconcile: failed to annotate orphaned HostSubnet %s: %v", sub.Host, err)
+	}
+}
+
+func (master *OsdnMaster) clearOrphanAnnotation(sub *osapi.HostSubnet) {
+	updated := *sub
+	delete(updated.Annotations, orphanSinceAnnotation)
+	if _, err := master.osClient.HostSubnets().Update(&updated); err != nil {
+		log.Errorf("Subnet reconcile: failed to clear orphan annotation on HostSubnet %s: %v", sub.Host, err)
+	}
+}
+
+func (master *OsdnMaster) deleteOrphanSubnet(sub *osapi.HostSubnet) {
+	log.Warningf("Subnet reconcile: releasing leaked HostSubnet %s (no matching Node)", hostSubnetToString(sub))
+	if err := master.deleteNode(sub.Host); err != nil {
+		log.Errorf("Subnet reconcile: failed to delete orphaned HostSubnet %s: %v", sub.Host, err)
+	}
+}
+
+// startSubnetReconcile kicks off the periodic resync; the initial
+// reconcile pass at master startup is a direct reconcileSubnets() call
+// from SubnetStartMaster so startup errors aren't silently deferred by a
+// full subnetReconcileInterval.
+func (master *OsdnMaster) startSubnetReconcile() {
+	go utilwait.Until(master.reconcileSubnets, subnetReconcileInterval, utilwait.NeverStop)
+}
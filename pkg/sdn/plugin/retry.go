@@ -0,0 +1,182 @@
+package plugin
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"k8s.io/kubernetes/pkg/types"
+	utilwait "k8s.io/kubernetes/pkg/util/wait"
+)
+
+// retryOp describes the kind of operation that is still pending for a
+// given object.
+type retryOp int
+
+const (
+	retryAdd retryOp = iota
+	retryUpdate
+	retryDelete
+)
+
+const (
+	retryInitialBackoff = 1 * time.Second
+	retryMaxBackoff     = 2 * time.Minute
+)
+
+// retryEntry tracks the last-seen version of an object that failed to be
+// processed, along with enough state to drive exponential backoff.
+type retryEntry struct {
+	uid     types.UID
+	obj     interface{}
+	op      retryOp
+	backoff time.Duration
+	failures int
+	next    time.Time
+}
+
+// retryQueue is a small per-subsystem retry/backoff store, keyed by object
+// UID. It is intentionally independent of the informer event queue: a
+// failed addNode/deleteNode or AddHostSubnetRules/DeleteHostSubnetRules
+// call enqueues itself here so it gets retried even if no further informer
+// event ever arrives for that object (e.g. a node stuck in a bad state).
+type retryQueue struct {
+	name string
+
+	lock    sync.Mutex
+	entries map[types.UID]*retryEntry
+
+	// process is called with the latest queued object for a UID. Returning
+	// nil clears the entry; any other error reschedules it with backoff.
+	process func(op retryOp, obj interface{}) error
+}
+
+func newRetryQueue(name string, process func(op retryOp, obj interface{}) error) *retryQueue {
+	return &retryQueue{
+		name:    name,
+		entries: make(map[types.UID]*retryEntry),
+		process: process,
+	}
+}
+
+// nextBackoff doubles the previous backoff (capped) and adds up to 20%
+// jitter so that a burst of failures doesn't retry in lockstep.
+func nextBackoff(prev time.Duration) time.Duration {
+	next := prev * 2
+	if next <= 0 || next > retryMaxBackoff {
+		next = retryMaxBackoff
+	}
+	jitter := time.Duration(rand.Int63n(int64(next) / 5))
+	return next + jitter
+}
+
+// Enqueue records that obj (identified by uid) needs op retried. Calling
+// Enqueue again for the same uid replaces the pending object and op with
+// the latest version, since a fresh failure means we should use up-to-date
+// data on the next attempt; the failure count and backoff carry on from
+// the existing entry rather than being reset.
+func (q *retryQueue) Enqueue(uid types.UID, op retryOp, obj interface{}) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	entry, exists := q.entries[uid]
+	if !exists {
+		entry = &retryEntry{uid: uid, backoff: retryInitialBackoff}
+		q.entries[uid] = entry
+	}
+	entry.obj = obj
+	entry.op = op
+	entry.failures++
+	entry.next = time.Now().Add(entry.backoff)
+	entry.backoff = nextBackoff(entry.backoff)
+	if entry.failures == retryTerminalThreshold {
+		retryTerminalFailures.WithLabelValues(q.name).Inc()
+	}
+
+	retryQueueDepth.WithLabelValues(q.name).Set(float64(len(q.entries)))
+}
+
+// Forget clears any pending retry for uid. watchNodes/watchSubnets call
+// this on a Deleted event so a pending add for an object that has since
+// been removed doesn't resurrect it.
+func (q *retryQueue) Forget(uid types.UID) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	delete(q.entries, uid)
+	retryQueueDepth.WithLabelValues(q.name).Set(float64(len(q.entries)))
+}
+
+// retryAttempt is an immutable snapshot of the fields retryOnce needs to
+// drive one retry attempt, copied out of a retryEntry while q.lock is
+// held. retryOnce runs with the lock released (q.process can be slow,
+// e.g. an API call), so it must never read a *retryEntry's fields
+// directly: Enqueue can be mutating that same entry concurrently from
+// watchNodes/watchSubnets, and obj is an interface{}, so a torn read can
+// panic on the type assertion in retryNode/retryHostSubnet.
+type retryAttempt struct {
+	uid      types.UID
+	op       retryOp
+	obj      interface{}
+	failures int
+}
+
+// dueEntries returns a snapshot of the entries whose next-retry time has
+// passed; it does not remove them.
+func (q *retryQueue) dueEntries() []retryAttempt {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	now := time.Now()
+	due := make([]retryAttempt, 0)
+	for _, entry := range q.entries {
+		if !entry.next.After(now) {
+			due = append(due, retryAttempt{uid: entry.uid, op: entry.op, obj: entry.obj, failures: entry.failures})
+		}
+	}
+	return due
+}
+
+// retryOnce drives one pass over the due entries, invoking q.process for
+// each. A nil error clears the entry; any other error reschedules it with
+// the next exponential backoff step, the same way Enqueue does, so a
+// permanently-failing object backs off toward retryMaxBackoff instead of
+// being retried every period forever.
+func (q *retryQueue) retryOnce() {
+	for _, attempt := range q.dueEntries() {
+		retryAttempts.WithLabelValues(q.name).Inc()
+		if err := q.process(attempt.op, attempt.obj); err != nil {
+			log.V(4).Infof("Retry of %s %v failed (attempt %d): %v", q.name, attempt.uid, attempt.failures, err)
+
+			q.lock.Lock()
+			if e, exists := q.entries[attempt.uid]; exists {
+				e.failures++
+				e.next = time.Now().Add(e.backoff)
+				e.backoff = nextBackoff(e.backoff)
+				if e.failures == retryTerminalThreshold {
+					retryTerminalFailures.WithLabelValues(q.name).Inc()
+				}
+			}
+			q.lock.Unlock()
+			continue
+		}
+		q.lock.Lock()
+		delete(q.entries, attempt.uid)
+		retryQueueDepth.WithLabelValues(q.name).Set(float64(len(q.entries)))
+		q.lock.Unlock()
+	}
+}
+
+// retryTerminalThreshold is the failure count at which we consider a
+// retry "stuck" for the purposes of the terminal-failure counter; the
+// entry is still retried afterwards, it's just also counted so alerting
+// can catch nodes/subnets that never recover.
+const retryTerminalThreshold = 10
+
+// Run starts the retry queue's background goroutine, checking for due
+// entries every period until stopCh is closed.
+func (q *retryQueue) Run(period time.Duration, stopCh <-chan struct{}) {
+	go utilwait.Until(q.retryOnce, period, stopCh)
+}
@@ -0,0 +1,119 @@
+package plugin
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"k8s.io/kubernetes/pkg/types"
+)
+
+// TestRetryQueueEventuallySucceeds injects osClient-style errors from
+// process and verifies the queue keeps retrying the same entry, with the
+// entry finally clearing once process stops returning an error.
+func TestRetryQueueEventuallySucceeds(t *testing.T) {
+	attempts := 0
+	const failuresBeforeSuccess = 2
+
+	q := newRetryQueue("test", func(op retryOp, obj interface{}) error {
+		attempts++
+		if attempts <= failuresBeforeSuccess {
+			return errors.New("injected osClient error")
+		}
+		return nil
+	})
+
+	uid := types.UID("node-a")
+	q.Enqueue(uid, retryAdd, "node-a")
+
+	for i := 0; i < failuresBeforeSuccess+1; i++ {
+		q.lock.Lock()
+		q.entries[uid].next = time.Now()
+		q.lock.Unlock()
+		q.retryOnce()
+	}
+
+	if attempts != failuresBeforeSuccess+1 {
+		t.Fatalf("expected %d attempts, got %d", failuresBeforeSuccess+1, attempts)
+	}
+	if _, exists := q.entries[uid]; exists {
+		t.Errorf("expected entry to be cleared from the queue after it eventually succeeds")
+	}
+}
+
+// TestRetryQueueBacksOffOnRepeatedFailure verifies that retryOnce itself
+// reschedules a failed entry with a growing backoff -- the thing the
+// background goroutine started by Run actually calls every tick -- rather
+// than leaving `next` in the past, which would retry a permanently-failing
+// object every fixed period forever instead of backing off toward
+// retryMaxBackoff.
+func TestRetryQueueBacksOffOnRepeatedFailure(t *testing.T) {
+	attempts := 0
+	q := newRetryQueue("test", func(op retryOp, obj interface{}) error {
+		attempts++
+		return errors.New("always fails")
+	})
+
+	uid := types.UID("node-a")
+	q.Enqueue(uid, retryAdd, "node-a")
+
+	q.lock.Lock()
+	initialBackoff := q.entries[uid].backoff
+	q.lock.Unlock()
+
+	// Make the first attempt due; from here on retryOnce must advance the
+	// schedule on its own -- the test never touches `next` again.
+	q.lock.Lock()
+	q.entries[uid].next = time.Now()
+	q.lock.Unlock()
+	q.retryOnce()
+
+	if attempts != 1 {
+		t.Fatalf("expected 1 attempt, got %d", attempts)
+	}
+
+	q.lock.Lock()
+	entry := *q.entries[uid]
+	q.lock.Unlock()
+
+	if !entry.next.After(time.Now()) {
+		t.Errorf("expected retryOnce to schedule the next attempt in the future after a failure, got %v", entry.next)
+	}
+	if entry.backoff <= initialBackoff {
+		t.Errorf("expected backoff to grow after a failed retry (was %v, now %v)", initialBackoff, entry.backoff)
+	}
+	if entry.failures != 2 {
+		t.Errorf("expected failures to be 2 after Enqueue + one failed retryOnce, got %d", entry.failures)
+	}
+
+	// The entry isn't due yet, so a second call must not invoke process
+	// again -- exactly the lockstep-retry behavior that was broken before
+	// retryOnce rescheduled its own entries.
+	q.retryOnce()
+	if attempts != 1 {
+		t.Errorf("expected retryOnce to skip an entry that backed off and isn't due yet, got %d attempts", attempts)
+	}
+}
+
+// TestRetryQueueForgetClearsPendingAdd verifies that Forget, the call
+// watchNodes/watchSubnets make on a Deleted event, clears any pending add
+// for the same UID so a queued retry doesn't resurrect a deleted object.
+func TestRetryQueueForgetClearsPendingAdd(t *testing.T) {
+	q := newRetryQueue("test", func(op retryOp, obj interface{}) error {
+		t.Fatalf("process should never run for an entry that was Forgotten")
+		return nil
+	})
+
+	uid := types.UID("node-a")
+	q.Enqueue(uid, retryAdd, "node-a")
+	if _, exists := q.entries[uid]; !exists {
+		t.Fatalf("expected entry to be queued after Enqueue")
+	}
+
+	q.Forget(uid)
+	if _, exists := q.entries[uid]; exists {
+		t.Errorf("expected Forget to clear the pending add")
+	}
+
+	q.retryOnce()
+}
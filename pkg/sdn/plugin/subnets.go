@@ -8,6 +8,7 @@ import (
 	log "github.com/golang/glog"
 
 	kapi "k8s.io/kubernetes/pkg/api"
+	kapierrors "k8s.io/kubernetes/pkg/api/errors"
 	kapiunversioned "k8s.io/kubernetes/pkg/api/unversioned"
 	"k8s.io/kubernetes/pkg/client/cache"
 	kclient "k8s.io/kubernetes/pkg/client/unversioned"
@@ -19,87 +20,313 @@ import (
 	"github.com/openshift/origin/pkg/util/netutils"
 )
 
-func (master *OsdnMaster) SubnetStartMaster(clusterNetwork *net.IPNet, hostSubnetLength uint32) error {
-	subrange := make([]string, 0)
+// ClusterNetworkEntry pairs a cluster CIDR with the per-node subnet length
+// to carve out of it, and the IPAM backend that should serve allocations
+// for it. SubnetStartMaster accepts one entry per address family (at most
+// one IPv4 and one IPv6), allowing dual-stack clusters to allocate a
+// HostSubnet from each.
+type ClusterNetworkEntry struct {
+	ClusterNetwork   *net.IPNet
+	HostSubnetLength uint32
+	IPAM             IPAMConfig
+}
+
+func (master *OsdnMaster) SubnetStartMaster(clusterNetworks []ClusterNetworkEntry) error {
+	subranges := make(map[netutils.IPFamily][]string)
+	for _, cn := range clusterNetworks {
+		subranges[netutils.FamilyOf(cn.ClusterNetwork)] = make([]string, 0)
+	}
+
 	subnets, err := master.osClient.HostSubnets().List(kapi.ListOptions{})
 	if err != nil {
 		log.Errorf("Error in initializing/fetching subnets: %v", err)
 		return err
 	}
 	for _, sub := range subnets.Items {
-		subrange = append(subrange, sub.Subnet)
-		if err = master.networkInfo.validateNodeIP(sub.HostIP); err != nil {
-			// Don't error out; just warn so the error can be corrected with 'oc'
-			log.Errorf("Failed to validate HostSubnet %s: %v", hostSubnetToString(&sub), err)
-		} else {
-			log.Infof("Found existing HostSubnet %s", hostSubnetToString(&sub))
+		for _, subnet := range hostSubnetSubnets(&sub) {
+			family := netutils.FamilyOfCIDRString(subnet)
+			subranges[family] = append(subranges[family], subnet)
 		}
+		for _, hostIP := range hostSubnetIPs(&sub) {
+			if err = master.networkInfo.validateNodeIP(hostIP); err != nil {
+				// Don't error out; just warn so the error can be corrected with 'oc'
+				log.Errorf("Failed to validate HostSubnet %s: %v", hostSubnetToString(&sub), err)
+			}
+		}
+		log.Infof("Found existing HostSubnet %s", hostSubnetToString(&sub))
 	}
 
-	master.subnetAllocator, err = netutils.NewSubnetAllocator(clusterNetwork.String(), hostSubnetLength, subrange)
-	if err != nil {
-		return err
+	master.subnetAllocators = make(map[netutils.IPFamily]IPAM)
+	for _, cn := range clusterNetworks {
+		family := netutils.FamilyOf(cn.ClusterNetwork)
+		allocator, err := NewIPAM(master.kClient, cn.ClusterNetwork, cn.HostSubnetLength, subranges[family], cn.IPAM)
+		if err != nil {
+			return err
+		}
+		master.subnetAllocators[family] = allocator
+	}
+
+	// Backends that implement NodeAwareReserver (e.g. zone IPAM) couldn't
+	// reserve existingSubnets above because a bare CIDR doesn't carry its
+	// owning zone; do that per-HostSubnet pass now that we know each
+	// subnet's Host. This is what makes those backends restart-safe: a
+	// CIDR already on record is reserved again instead of silently
+	// forgotten and handed out to a different node.
+	for i := range subnets.Items {
+		sub := &subnets.Items[i]
+		for _, subnetStr := range hostSubnetSubnets(sub) {
+			_, ipnet, err := net.ParseCIDR(subnetStr)
+			if err != nil {
+				log.Errorf("Error parsing existing subnet %q for node %s: %v", subnetStr, sub.Host, err)
+				continue
+			}
+			allocator, ok := master.subnetAllocators[netutils.FamilyOf(ipnet)]
+			if !ok {
+				continue
+			}
+			if reserver, ok := allocator.(NodeAwareReserver); ok {
+				if err := reserver.ReserveForNode(sub.Host, ipnet); err != nil {
+					log.Errorf("Error reserving existing subnet %s for node %s: %v", subnetStr, sub.Host, err)
+				}
+			}
+		}
+	}
+
+	master.nodeRetries = newRetryQueue("nodes", func(op retryOp, obj interface{}) error {
+		return master.retryNode(op, obj.(string))
+	})
+	master.nodeRetries.Run(10*time.Second, utilwait.NeverStop)
+
+	if master.gatewayElectionEnabled {
+		master.StartGatewayElection(master.gatewayHealthCheckConfig)
 	}
 
+	// Reconcile once up-front so a Node deleted while the master was down
+	// doesn't leak its HostSubnet forever, then keep resyncing periodically.
+	master.reconcileSubnets()
+	master.startSubnetReconcile()
+
 	go utilwait.Forever(master.watchNodes, 0)
 	return nil
 }
 
-func (master *OsdnMaster) addNode(nodeName string, nodeIP string) error {
-	// Validate node IP before proceeding
-	if err := master.networkInfo.validateNodeIP(nodeIP); err != nil {
+// subnetFamilies returns the configured cluster network families, IPv4
+// first, so per-family results (e.g. from getNodeIPs) have a stable order.
+func (master *OsdnMaster) subnetFamilies() []netutils.IPFamily {
+	families := make([]netutils.IPFamily, 0, len(master.subnetAllocators))
+	if _, ok := master.subnetAllocators[netutils.IPv4]; ok {
+		families = append(families, netutils.IPv4)
+	}
+	if _, ok := master.subnetAllocators[netutils.IPv6]; ok {
+		families = append(families, netutils.IPv6)
+	}
+	return families
+}
+
+// retryNode is invoked by master.nodeRetries for a queued add/update/delete
+// that previously failed. It always re-fetches the current Node from the
+// API rather than trusting the object captured at enqueue time, so that
+// e.g. a node that was re-added after a failed delete isn't clobbered, and
+// a stale delete doesn't race a new Create.
+func (master *OsdnMaster) retryNode(op retryOp, nodeName string) error {
+	node, err := master.kClient.Nodes().Get(nodeName)
+	if kapierrors.IsNotFound(err) {
+		return master.deleteNode(nodeName)
+	}
+	if err != nil {
+		return err
+	}
+	// A Node that still exists (e.g. re-added after a failed delete) keeps
+	// its subnet, whatever op was queued.
+
+	nodeIPs, err := getNodeIPs(node, master.subnetFamilies())
+	if err != nil {
 		return err
 	}
+	return master.addNode(nodeName, nodeIPs)
+}
+
+// hostSubnetSubnets returns the per-family CIDRs held by hs, preferring the
+// repeated Subnets field (dual-stack) and falling back to the legacy
+// scalar Subnet field for HostSubnets written before dual-stack support.
+func hostSubnetSubnets(hs *osapi.HostSubnet) []string {
+	if len(hs.Subnets) > 0 {
+		return hs.Subnets
+	}
+	if hs.Subnet != "" {
+		return []string{hs.Subnet}
+	}
+	return nil
+}
+
+// hostSubnetIPs is the HostIPs/HostIP analog of hostSubnetSubnets.
+func hostSubnetIPs(hs *osapi.HostSubnet) []string {
+	if len(hs.HostIPs) > 0 {
+		return hs.HostIPs
+	}
+	if hs.HostIP != "" {
+		return []string{hs.HostIP}
+	}
+	return nil
+}
+
+// clusterNetworkCIDRs is the cluster-network analog of hostSubnetSubnets:
+// it returns one CIDR per configured address family (ClusterNetworks for
+// dual-stack, falling back to the legacy scalar ClusterNetwork), in the
+// same order as localSubnets, so SubnetStartNode can plumb matching
+// per-family CIDRs through to SetupSDN.
+func clusterNetworkCIDRs(ni *NetworkInfo) []string {
+	if len(ni.ClusterNetworks) > 0 {
+		cidrs := make([]string, 0, len(ni.ClusterNetworks))
+		for _, cn := range ni.ClusterNetworks {
+			cidrs = append(cidrs, cn.String())
+		}
+		return cidrs
+	}
+	return []string{ni.ClusterNetwork.String()}
+}
+
+// missingSubnetFamilies returns the configured cluster network families
+// sub has no Subnets entry for, e.g. because it was created before
+// dual-stack was enabled on this cluster. addNode tops these up with a
+// fresh allocation instead of leaving a pre-dual-stack HostSubnet stuck
+// on a single family forever.
+func (master *OsdnMaster) missingSubnetFamilies(sub *osapi.HostSubnet) []netutils.IPFamily {
+	have := make(map[netutils.IPFamily]bool)
+	for _, subnet := range hostSubnetSubnets(sub) {
+		have[netutils.FamilyOfCIDRString(subnet)] = true
+	}
+	missing := make([]netutils.IPFamily, 0)
+	for _, family := range master.subnetFamilies() {
+		if !have[family] {
+			missing = append(missing, family)
+		}
+	}
+	return missing
+}
+
+// allocateSubnets allocates one subnet per family in families for
+// nodeName, returning the per-family CIDRs, their string form (in the
+// same order as families), and a cleanup func that releases everything
+// allocated so far, for callers to use if a later step fails.
+func (master *OsdnMaster) allocateSubnets(nodeName string, families []netutils.IPFamily) (map[netutils.IPFamily]*net.IPNet, []string, func(), error) {
+	allocated := make(map[netutils.IPFamily]*net.IPNet, len(families))
+	subnets := make([]string, 0, len(families))
+	release := func() {
+		for family, sn := range allocated {
+			master.subnetAllocators[family].Release(sn)
+		}
+	}
+	for _, family := range families {
+		sn, err := master.subnetAllocators[family].Allocate(nodeName)
+		if err != nil {
+			release()
+			return nil, nil, nil, fmt.Errorf("Error allocating %s network for node %s: %v", family, nodeName, err)
+		}
+		allocated[family] = sn
+		subnets = append(subnets, sn.String())
+	}
+	return allocated, subnets, release, nil
+}
+
+// addNode allocates (or updates) the HostSubnet for nodeName, allocating
+// one subnet per configured cluster network family. nodeIPs holds one
+// address per family that validateNodeIP accepts, in the same family order
+// as master.subnetFamilies().
+func (master *OsdnMaster) addNode(nodeName string, nodeIPs []string) error {
+	for _, nodeIP := range nodeIPs {
+		if err := master.networkInfo.validateNodeIP(nodeIP); err != nil {
+			return err
+		}
+	}
 
 	// Check if subnet needs to be created or updated
 	sub, err := master.osClient.HostSubnets().Get(nodeName)
 	if err == nil {
-		if sub.HostIP == nodeIP {
+		missing := master.missingSubnetFamilies(sub)
+		if stringSlicesEqual(hostSubnetIPs(sub), nodeIPs) && len(missing) == 0 {
 			return nil
-		} else {
-			// Node IP changed, update old subnet
-			sub.HostIP = nodeIP
-			sub, err = master.osClient.HostSubnets().Update(sub)
+		}
+
+		updated := *sub
+		updated.HostIPs = nodeIPs
+		updated.HostIP = nodeIPs[0]
+
+		var release func()
+		if len(missing) > 0 {
+			_, newSubnets, r, err := master.allocateSubnets(nodeName, missing)
 			if err != nil {
-				return fmt.Errorf("Error updating subnet %s for node %s: %v", sub.Subnet, nodeName, err)
+				return err
 			}
-			log.Infof("Updated HostSubnet %s", hostSubnetToString(sub))
-			return nil
+			release = r
+			updated.Subnets = append(append([]string{}, hostSubnetSubnets(sub)...), newSubnets...)
+			if updated.Subnet == "" {
+				updated.Subnet = updated.Subnets[0]
+			}
+			log.Infof("Topping up HostSubnet %s with dual-stack subnet(s) %v for node %s", hostSubnetToString(sub), newSubnets, nodeName)
+		}
+
+		sub, err = master.osClient.HostSubnets().Update(&updated)
+		if err != nil {
+			if release != nil {
+				release()
+			}
+			return fmt.Errorf("Error updating subnet %s for node %s: %v", hostSubnetToString(&updated), nodeName, err)
 		}
+		log.Infof("Updated HostSubnet %s", hostSubnetToString(sub))
+		return nil
 	}
 
-	// Create new subnet
-	sn, err := master.subnetAllocator.GetNetwork()
+	// Create new subnet(s), one per configured cluster network family
+	_, subnets, releaseAllocated, err := master.allocateSubnets(nodeName, master.subnetFamilies())
 	if err != nil {
-		return fmt.Errorf("Error allocating network for node %s: %v", nodeName, err)
+		return err
 	}
 
 	sub = &osapi.HostSubnet{
 		TypeMeta:   kapiunversioned.TypeMeta{Kind: "HostSubnet"},
 		ObjectMeta: kapi.ObjectMeta{Name: nodeName},
 		Host:       nodeName,
-		HostIP:     nodeIP,
-		Subnet:     sn.String(),
+		HostIP:     nodeIPs[0],
+		HostIPs:    nodeIPs,
+		Subnet:     subnets[0],
+		Subnets:    subnets,
 	}
 	sub, err = master.osClient.HostSubnets().Create(sub)
 	if err != nil {
-		master.subnetAllocator.ReleaseNetwork(sn)
-		return fmt.Errorf("Error creating subnet %s for node %s: %v", sn.String(), nodeName, err)
+		releaseAllocated()
+		return fmt.Errorf("Error creating subnet %v for node %s: %v", subnets, nodeName, err)
 	}
 	log.Infof("Created HostSubnet %s", hostSubnetToString(sub))
 	return nil
 }
 
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func (master *OsdnMaster) deleteNode(nodeName string) error {
 	sub, err := master.osClient.HostSubnets().Get(nodeName)
 	if err != nil {
 		return fmt.Errorf("Error fetching subnet for node %q for deletion: %v", nodeName, err)
 	}
-	_, ipnet, err := net.ParseCIDR(sub.Subnet)
-	if err != nil {
-		return fmt.Errorf("Error parsing subnet %q for node %q for deletion: %v", sub.Subnet, nodeName, err)
+	for _, subnet := range hostSubnetSubnets(sub) {
+		_, ipnet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return fmt.Errorf("Error parsing subnet %q for node %q for deletion: %v", subnet, nodeName, err)
+		}
+		if allocator, ok := master.subnetAllocators[netutils.FamilyOf(ipnet)]; ok {
+			allocator.Release(ipnet)
+		}
 	}
-	master.subnetAllocator.ReleaseNetwork(ipnet)
 	err = master.osClient.HostSubnets().Delete(nodeName)
 	if err != nil {
 		return fmt.Errorf("Error deleting subnet %v for node %q: %v", sub, nodeName, err)
@@ -117,6 +344,35 @@ func getNodeIP(node *kapi.Node) (string, error) {
 	}
 }
 
+// getNodeIPs returns one address per configured cluster network family
+// (IPv4, and IPv6 when dual-stack is enabled), in the order of families
+// (as returned by master.subnetFamilies()), so addNode can allocate a matching HostSubnet
+// per family.
+func getNodeIPs(node *kapi.Node, families []netutils.IPFamily) ([]string, error) {
+	primary, err := getNodeIP(node)
+	if err != nil {
+		return nil, err
+	}
+
+	byFamily := map[netutils.IPFamily]string{netutils.FamilyOfIPString(primary): primary}
+	for _, addr := range node.Status.Addresses {
+		family := netutils.FamilyOfIPString(addr.Address)
+		if _, ok := byFamily[family]; !ok && addr.Address != "" {
+			byFamily[family] = addr.Address
+		}
+	}
+
+	nodeIPs := make([]string, 0, len(families))
+	for _, family := range families {
+		ip, ok := byFamily[family]
+		if !ok {
+			return nil, fmt.Errorf("node %s has no %s address", node.Name, family)
+		}
+		nodeIPs = append(nodeIPs, ip)
+	}
+	return nodeIPs, nil
+}
+
 // Because openshift-sdn uses an overlay and doesn't need GCE Routes, we need to
 // clear the NetworkUnavailable condition that kubelet adds to initial node
 // status when using GCE.
@@ -158,13 +414,14 @@ func (master *OsdnMaster) clearInitialNodeNetworkUnavailableCondition(node *kapi
 }
 
 func (master *OsdnMaster) watchNodes() {
-	nodeAddressMap := map[types.UID]string{}
+	nodeAddressMap := map[types.UID][]string{}
+	families := master.subnetFamilies()
 	RunEventQueue(master.kClient, Nodes, func(delta cache.Delta) error {
 		node := delta.Object.(*kapi.Node)
 		name := node.ObjectMeta.Name
 		uid := node.ObjectMeta.UID
 
-		nodeIP, err := getNodeIP(node)
+		nodeIPs, err := getNodeIPs(node, families)
 		if err != nil {
 			return fmt.Errorf("failed to get node IP for %s, skipping event: %v, node: %v", name, delta.Type, node)
 		}
@@ -173,24 +430,32 @@ func (master *OsdnMaster) watchNodes() {
 		case cache.Sync, cache.Added, cache.Updated:
 			master.clearInitialNodeNetworkUnavailableCondition(node)
 
-			if oldNodeIP, ok := nodeAddressMap[uid]; ok && (oldNodeIP == nodeIP) {
+			if oldNodeIPs, ok := nodeAddressMap[uid]; ok && stringSlicesEqual(oldNodeIPs, nodeIPs) {
 				break
 			}
 			// Node status is frequently updated by kubelet, so log only if the above condition is not met
 			log.V(5).Infof("Watch %s event for Node %q", delta.Type, name)
 
-			err = master.addNode(name, nodeIP)
+			err = master.addNode(name, nodeIPs)
 			if err != nil {
-				return fmt.Errorf("error creating subnet for node %s, ip %s: %v", name, nodeIP, err)
+				log.Errorf("Error creating subnet for node %s, ips %v: %v; queued for retry", name, nodeIPs, err)
+				master.nodeRetries.Enqueue(uid, retryAdd, name)
+			} else {
+				master.nodeRetries.Forget(uid)
 			}
-			nodeAddressMap[uid] = nodeIP
+			nodeAddressMap[uid] = nodeIPs
 		case cache.Deleted:
 			log.V(5).Infof("Watch %s event for Node %q", delta.Type, name)
 			delete(nodeAddressMap, uid)
+			// A Deleted event always wins over any pending add/update for
+			// this UID, otherwise a queued retry could re-create the
+			// subnet for a node that is already gone.
+			master.nodeRetries.Forget(uid)
 
 			err = master.deleteNode(name)
 			if err != nil {
-				return fmt.Errorf("Error deleting node %s: %v", name, err)
+				log.Errorf("Error deleting node %s: %v; queued for retry", name, err)
+				master.nodeRetries.Enqueue(uid, retryDelete, name)
 			}
 		}
 		return nil
@@ -203,15 +468,50 @@ func (node *OsdnNode) SubnetStartNode(mtu uint32) (bool, error) {
 		return false, err
 	}
 
-	networkChanged, err := node.SetupSDN(node.localSubnet.Subnet, node.networkInfo.ClusterNetwork.String(), node.networkInfo.ServiceNetwork.String(), mtu)
+	// localSubnets carries one CIDR per configured address family (both an
+	// IPv4 and an IPv6 /23 for dual-stack, just the one legacy Subnet
+	// value for single-stack); pass all of them through to SetupSDN so it
+	// can program OVS flows for every family, not just the first.
+	localSubnets := hostSubnetSubnets(node.localSubnet)
+	networkChanged, err := node.SetupSDN(localSubnets, clusterNetworkCIDRs(node.networkInfo), node.networkInfo.ServiceNetwork.String(), mtu)
 	if err != nil {
 		return false, err
 	}
 
+	node.subnetRetries = newRetryQueue("hostsubnets", func(op retryOp, obj interface{}) error {
+		return node.retryHostSubnet(op, obj.(*osapi.HostSubnet))
+	})
+	node.subnetRetries.Run(10*time.Second, utilwait.NeverStop)
+
 	go utilwait.Forever(node.watchSubnets, 0)
 	return networkChanged, nil
 }
 
+// retryHostSubnet is invoked by node.subnetRetries for a queued
+// AddHostSubnetRules/DeleteHostSubnetRules call that previously failed. It
+// re-fetches the HostSubnet from the API before retrying a non-delete op,
+// so a retry doesn't program rules for a subnet that has since been
+// reassigned to a different node.
+func (node *OsdnNode) retryHostSubnet(op retryOp, hs *osapi.HostSubnet) error {
+	if op == retryDelete {
+		return node.DeleteHostSubnetRules(hs)
+	}
+
+	current, err := node.osClient.HostSubnets().Get(hs.ObjectMeta.Name)
+	if kapierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if current.UID != hs.UID {
+		// The HostSubnet was deleted and recreated (or reassigned); the
+		// normal watchSubnets flow will have already handled the new one.
+		return nil
+	}
+	return node.AddHostSubnetRules(current)
+}
+
 func (node *OsdnNode) initSelfSubnet() error {
 	// timeout: 30 secs
 	retries := 60
@@ -242,6 +542,19 @@ func (node *OsdnNode) initSelfSubnet() error {
 	return nil
 }
 
+// hostSubnetRulesUnchanged reports whether old and new carry the same
+// fields that AddHostSubnetRules cares about, so watchSubnets can skip
+// reprogramming OVS flows on updates that don't affect them (e.g. a
+// status-only HostSubnet update). HostIP changes always require
+// reprogramming; so does a gateway-election update to EgressGateway/
+// EgressGatewayActive, since that's what drives centralized-egress route
+// changes on every other node.
+func hostSubnetRulesUnchanged(old, new *osapi.HostSubnet) bool {
+	return old.HostIP == new.HostIP &&
+		old.EgressGateway == new.EgressGateway &&
+		old.EgressGatewayActive == new.EgressGatewayActive
+}
+
 // Only run on the nodes
 func (node *OsdnNode) watchSubnets() {
 	subnets := make(map[string]*osapi.HostSubnet)
@@ -256,12 +569,13 @@ func (node *OsdnNode) watchSubnets() {
 		case cache.Sync, cache.Added, cache.Updated:
 			oldSubnet, exists := subnets[string(hs.UID)]
 			if exists {
-				if oldSubnet.HostIP == hs.HostIP {
+				if hostSubnetRulesUnchanged(oldSubnet, hs) {
 					break
 				} else {
 					// Delete old subnet rules
 					if err := node.DeleteHostSubnetRules(oldSubnet); err != nil {
-						return err
+						log.Errorf("Error deleting stale rules for subnet %s: %v; queued for retry", hostSubnetToString(oldSubnet), err)
+						node.subnetRetries.Enqueue(oldSubnet.UID, retryDelete, oldSubnet)
 					}
 				}
 			}
@@ -271,13 +585,21 @@ func (node *OsdnNode) watchSubnets() {
 			}
 
 			if err := node.AddHostSubnetRules(hs); err != nil {
-				return err
+				log.Errorf("Error adding rules for subnet %s: %v; queued for retry", hostSubnetToString(hs), err)
+				node.subnetRetries.Enqueue(hs.UID, retryAdd, hs)
+			} else {
+				node.subnetRetries.Forget(hs.UID)
 			}
 			subnets[string(hs.UID)] = hs
 		case cache.Deleted:
 			delete(subnets, string(hs.UID))
+			// A Deleted event wins over any pending add/update retry for
+			// this UID so we don't re-create rules for a subnet that's
+			// already gone.
+			node.subnetRetries.Forget(hs.UID)
 			if err := node.DeleteHostSubnetRules(hs); err != nil {
-				return err
+				log.Errorf("Error deleting rules for subnet %s: %v; queued for retry", hostSubnetToString(hs), err)
+				node.subnetRetries.Enqueue(hs.UID, retryDelete, hs)
 			}
 		}
 		return nil